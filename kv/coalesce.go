@@ -0,0 +1,145 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package kv
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/cockroachdb/cockroach/roachpb"
+)
+
+// coalesceEntry records, for one request of the original (pre-coalesce)
+// batch that was folded into a coalesced ScanRequest, the sub-span of that
+// scan's results which belongs to it. The entry does not name the scan
+// itself; that is the coalesced ScanRequest whose span contains span. A
+// caller can use the mapping to demultiplex a single coalesced response
+// back into each original request's slot.
+type coalesceEntry struct {
+	// idx is the request's position in ba.Requests as it stood when
+	// truncateAndCoalesce was called.
+	idx int
+	// span is the sub-span, within the coalesced scan covering idx, that
+	// idx's own request originally asked for.
+	span roachpb.Span
+}
+
+// truncateAndCoalesce behaves exactly like truncate, additionally sorting
+// the surviving (post-truncation) requests and merging abutting or
+// overlapping read-only Get/Scan spans into a single ScanRequest. This
+// cuts down on RPC overhead for batches built from many small, adjacent
+// reads -- e.g. a bulk-delete or backup job that issued one GetRequest
+// per row -- at the cost of the caller having to demultiplex the merged
+// response using the returned []coalesceEntry.
+//
+// Coalescing never merges writes or conditional requests (CPut, Inc,
+// DeleteRange, ...) -- only plain Get/Scan reads are candidates. Every
+// request in ba already shares the same ReadConsistency and
+// MaxSpanRequestKeys, since those live on the batch's own Header rather
+// than per-request, so merging two reads can never silently change either.
+// The returned undo restores ba byte-for-byte, exactly as truncate's
+// would, regardless of what coalescing did on top.
+func truncateAndCoalesce(
+	ba *roachpb.BatchRequest, desc *roachpb.RangeDescriptor, from, to roachpb.RKey,
+) (func(), int, []coalesceEntry, error) {
+	origUnions := make([]roachpb.RequestUnion, len(ba.Requests))
+	origHeaders := make([]roachpb.Span, len(ba.Requests))
+	for i, union := range ba.Requests {
+		origUnions[i] = union
+		origHeaders[i] = union.GetInner().Header()
+	}
+	undo := func() {
+		for i := range ba.Requests {
+			ba.Requests[i] = origUnions[i]
+			ba.Requests[i].GetInner().SetHeader(origHeaders[i])
+		}
+	}
+
+	if _, _, err := truncate(ba, desc, from, to); err != nil {
+		undo()
+		return nil, 0, nil, err
+	}
+
+	entries := coalesceRequests(ba)
+
+	var num int
+	for _, union := range ba.Requests {
+		if _, ok := union.GetInner().(*roachpb.NoopRequest); !ok {
+			num++
+		}
+	}
+	return undo, num, entries, nil
+}
+
+// coalesceRequests sorts and merges ba's surviving read-only Get/Scan
+// requests in place, leaving writes, conditional requests, and anything
+// else untouched. It returns the mapping needed to demultiplex the merged
+// scans' responses.
+func coalesceRequests(ba *roachpb.BatchRequest) []coalesceEntry {
+	type candidate struct {
+		idx  int
+		span roachpb.Span
+	}
+
+	var cands []candidate
+	for i, union := range ba.Requests {
+		switch r := union.GetInner().(type) {
+		case *roachpb.GetRequest:
+			cands = append(cands, candidate{idx: i, span: roachpb.Span{Key: r.Key, EndKey: r.Key.Next()}})
+		case *roachpb.ScanRequest:
+			cands = append(cands, candidate{idx: i, span: r.Span})
+		default:
+			// Writes, conditional requests, reverse scans, NoopRequests
+			// left behind by truncate, etc. are never coalesced.
+		}
+	}
+	if len(cands) < 2 {
+		return nil
+	}
+	sort.Slice(cands, func(i, j int) bool {
+		return bytes.Compare(cands[i].span.Key, cands[j].span.Key) < 0
+	})
+
+	var entries []coalesceEntry
+	for i := 0; i < len(cands); {
+		j := i + 1
+		groupEnd := cands[i].span.EndKey
+		for j < len(cands) && bytes.Compare(cands[j].span.Key, groupEnd) <= 0 {
+			if bytes.Compare(cands[j].span.EndKey, groupEnd) > 0 {
+				groupEnd = cands[j].span.EndKey
+			}
+			j++
+		}
+		if j-i > 1 {
+			merged := roachpb.Span{Key: cands[i].span.Key, EndKey: groupEnd}
+			scan := &roachpb.ScanRequest{}
+			scan.SetHeader(merged)
+
+			head := cands[i].idx
+			ba.Requests[head] = roachpb.RequestUnion{}
+			ba.Requests[head].MustSetInner(scan)
+
+			for k := i; k < j; k++ {
+				entries = append(entries, coalesceEntry{idx: cands[k].idx, span: cands[k].span})
+				if cands[k].idx != head {
+					ba.Requests[cands[k].idx] = roachpb.RequestUnion{}
+					ba.Requests[cands[k].idx].MustSetInner(&roachpb.NoopRequest{})
+				}
+			}
+		}
+		i = j
+	}
+	return entries
+}
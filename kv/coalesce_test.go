@@ -0,0 +1,162 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package kv
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/roachpb"
+	"github.com/cockroachdb/cockroach/util/leaktest"
+	"github.com/gogo/protobuf/proto"
+)
+
+func TestTruncateAndCoalesce(t *testing.T) {
+	defer leaktest.AfterTest(t)
+
+	testCases := []struct {
+		name string
+		// build returns the batch to truncate-and-coalesce.
+		build func() *roachpb.BatchRequest
+		// wantTypes lists, for each surviving slot (by original index), the
+		// concrete type name the slot should hold after coalescing.
+		wantTypes []string
+		// wantGroups is the number of indices expected in the returned
+		// mapping; 0 means no coalescing happened.
+		wantGroups int
+	}{
+		{
+			// Each key is the immediate successor of the previous one's
+			// Get span (k, k.Next(), k.Next().Next(), ...), so their
+			// synthesized [Key, Key.Next()) spans abut exactly.
+			name: "many single-key Gets collapse into one Scan",
+			build: func() *roachpb.BatchRequest {
+				ba := &roachpb.BatchRequest{}
+				k := roachpb.Key("a")
+				for i := 0; i < 3; i++ {
+					ba.Add(&roachpb.GetRequest{Span: roachpb.Span{Key: k}})
+					k = k.Next()
+				}
+				return ba
+			},
+			wantTypes:  []string{"*roachpb.ScanRequest", "*roachpb.NoopRequest", "*roachpb.NoopRequest"},
+			wantGroups: 3,
+		},
+		{
+			name: "overlapping Scans merge",
+			build: func() *roachpb.BatchRequest {
+				ba := &roachpb.BatchRequest{}
+				ba.Add(&roachpb.ScanRequest{Span: roachpb.Span{Key: roachpb.Key("a"), EndKey: roachpb.Key("d")}})
+				ba.Add(&roachpb.ScanRequest{Span: roachpb.Span{Key: roachpb.Key("c"), EndKey: roachpb.Key("f")}})
+				return ba
+			},
+			wantTypes:  []string{"*roachpb.ScanRequest", "*roachpb.NoopRequest"},
+			wantGroups: 2,
+		},
+		{
+			// The first two Gets are adjacent and merge; the Put never
+			// coalesces; the last Get is far from everything else and so
+			// has nothing to merge with.
+			name: "heterogeneous batch only partially coalesces",
+			build: func() *roachpb.BatchRequest {
+				ba := &roachpb.BatchRequest{}
+				ba.Add(&roachpb.GetRequest{Span: roachpb.Span{Key: roachpb.Key("a")}})
+				ba.Add(&roachpb.GetRequest{Span: roachpb.Span{Key: roachpb.Key("a").Next()}})
+				ba.Add(&roachpb.PutRequest{Span: roachpb.Span{Key: roachpb.Key("m")}})
+				ba.Add(&roachpb.GetRequest{Span: roachpb.Span{Key: roachpb.Key("z")}})
+				return ba
+			},
+			wantTypes:  []string{"*roachpb.ScanRequest", "*roachpb.NoopRequest", "*roachpb.PutRequest", "*roachpb.GetRequest"},
+			wantGroups: 2,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			ba := test.build()
+			original := proto.Clone(ba).(*roachpb.BatchRequest)
+			desc := &roachpb.RangeDescriptor{StartKey: roachpb.RKeyMin, EndKey: roachpb.RKeyMax}
+
+			undo, _, entries, err := truncateAndCoalesce(ba, desc, roachpb.RKeyMin, roachpb.RKeyMax)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != test.wantGroups {
+				t.Errorf("got %d mapping entries, want %d", len(entries), test.wantGroups)
+			}
+			for i, want := range test.wantTypes {
+				if got := reflect.TypeOf(ba.Requests[i].GetInner()).String(); got != want {
+					t.Errorf("slot %d: got %s, want %s", i, got, want)
+				}
+			}
+
+			undo()
+			if !reflect.DeepEqual(ba, original) {
+				t.Errorf("undo failed:\nexpected: %s\nactual: %s", original, ba)
+			}
+		})
+	}
+}
+
+// TestTruncateAndCoalesceRoundTrip verifies that a response synthesized
+// for a coalesced scan can be re-split, using the returned mapping, back
+// into the rows each original request asked for.
+func TestTruncateAndCoalesceRoundTrip(t *testing.T) {
+	defer leaktest.AfterTest(t)
+
+	keys := []roachpb.Key{roachpb.Key("a"), roachpb.Key("a").Next(), roachpb.Key("a").Next().Next()}
+	ba := &roachpb.BatchRequest{}
+	for _, k := range keys {
+		ba.Add(&roachpb.GetRequest{Span: roachpb.Span{Key: k}})
+	}
+	desc := &roachpb.RangeDescriptor{StartKey: roachpb.RKeyMin, EndKey: roachpb.RKeyMax}
+
+	_, _, entries, err := truncateAndCoalesce(ba, desc, roachpb.RKeyMin, roachpb.RKeyMax)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 mapping entries, got %d", len(entries))
+	}
+
+	// Synthesize the rows a real Scan over the merged span would return.
+	rows := []roachpb.KeyValue{
+		{Key: keys[0]},
+		{Key: keys[1]},
+		{Key: keys[2]},
+	}
+
+	for _, want := range keys {
+		var entry *coalesceEntry
+		for i := range entries {
+			if string(entries[i].span.Key) == string(want) {
+				entry = &entries[i]
+				break
+			}
+		}
+		if entry == nil {
+			t.Fatalf("no mapping entry for key %q", want)
+		}
+		var got []roachpb.KeyValue
+		for _, row := range rows {
+			if roachpb.Key(row.Key).Compare(entry.span.Key) >= 0 && roachpb.Key(row.Key).Compare(entry.span.EndKey) < 0 {
+				got = append(got, row)
+			}
+		}
+		if len(got) != 1 || string(got[0].Key) != string(want) {
+			t.Errorf("demuxed rows for %q: got %v", want, got)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package kv
+
+import (
+	"github.com/cockroachdb/cockroach/keys"
+	"github.com/cockroachdb/cockroach/roachpb"
+	"github.com/gogo/protobuf/proto"
+	"golang.org/x/net/context"
+)
+
+// RangePlan is one step of a batch plan produced by PlanBatch: the
+// descriptor of a range the originating BatchRequest touches, and the
+// portion of that batch -- already truncated to the range's span -- that
+// should be sent to it.
+type RangePlan struct {
+	Desc  roachpb.RangeDescriptor
+	Batch *roachpb.BatchRequest
+	// Num is the number of Batch's requests that are not NoopRequests.
+	Num int
+}
+
+// PlanBatch splits ba into one RangePlan per range holding at least one
+// of ba's requests, resolving descriptors via rdc; a range that ba's span
+// merely crosses, with none of ba's requests in it, gets no plan. Unlike RangeIterator, which truncates ba
+// in place for sequential dispatch and relies on the caller to undo each
+// step, PlanBatch never mutates the input ba: every RangePlan carries its
+// own clone, so the whole plan can be hung onto, parallelized across
+// ranges, or inspected (e.g. to estimate work, or to reject batches that
+// fan out too widely -- see CountRanges) before any RPC is issued.
+//
+// PlanBatch reuses truncate's semantics verbatim, by driving a
+// RangeIterator over ba and cloning its yielded batch at each step; the
+// same range-local validation and NoopRequest substitution apply.
+func PlanBatch(
+	ctx context.Context, ba *roachpb.BatchRequest, rdc *RangeDescriptorCache,
+) ([]RangePlan, error) {
+	rs, err := batchSpan(ba)
+	if err != nil {
+		return nil, err
+	}
+	reverse := ba.IsReverse()
+
+	var plans []RangePlan
+	err = forEachRange(ctx, ba, rdc, rs, reverse, func(ri *RangeIterator) {
+		truncated, num := ri.Batch()
+		plans = append(plans, RangePlan{
+			Desc:  *ri.Desc(),
+			Batch: proto.Clone(truncated).(*roachpb.BatchRequest),
+			Num:   num,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if reverse {
+		for i, j := 0, len(plans)-1; i < j; i, j = i+1, j-1 {
+			plans[i], plans[j] = plans[j], plans[i]
+		}
+	}
+	return plans, nil
+}
+
+// CountRanges returns the number of ranges holding at least one of ba's
+// requests, according to rdc; ranges that ba's span crosses without any
+// of ba's requests in them are not counted. It drives the same RangeIterator traversal as PlanBatch but
+// discards the truncated batches, making it a cheap way for a caller to
+// estimate fan-out -- and reject the batch if it exceeds some
+// configurable range-count threshold -- before committing to a full plan.
+func CountRanges(ctx context.Context, ba *roachpb.BatchRequest, rdc *RangeDescriptorCache) (int, error) {
+	rs, err := batchSpan(ba)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	err = forEachRange(ctx, ba, rdc, rs, ba.IsReverse(), func(*RangeIterator) {
+		n++
+	})
+	return n, err
+}
+
+// forEachRange drives a RangeIterator over ba's span, calling fn once per
+// range with the iterator positioned there, and undoing each step's
+// truncation before moving on so that ba itself is left untouched once
+// forEachRange returns.
+func forEachRange(
+	ctx context.Context,
+	ba *roachpb.BatchRequest,
+	rdc *RangeDescriptorCache,
+	rs roachpb.RSpan,
+	reverse bool,
+	fn func(*RangeIterator),
+) error {
+	ri := NewRangeIterator(rdc, ba, rs, reverse)
+	start := rs.Key
+	if reverse {
+		start = rs.EndKey
+	}
+	for ri.Seek(ctx, start); ri.Valid(); ri.Next(ctx) {
+		fn(ri)
+		ri.Undo()()
+	}
+	return ri.Error()
+}
+
+// batchSpan computes the union of all of ba's constituent request spans,
+// for use as the initial bound passed to a RangeIterator.
+func batchSpan(ba *roachpb.BatchRequest) (roachpb.RSpan, error) {
+	rs := roachpb.RSpan{Key: roachpb.RKeyMax, EndKey: roachpb.RKeyMin}
+	for _, union := range ba.Requests {
+		h := union.GetInner().Header()
+		keyAddr, err := keys.Addr(h.Key)
+		if err != nil {
+			return roachpb.RSpan{}, err
+		}
+		endKeyAddr := keyAddr.Next()
+		if len(h.EndKey) > 0 {
+			if endKeyAddr, err = keys.Addr(h.EndKey); err != nil {
+				return roachpb.RSpan{}, err
+			}
+		}
+		if keyAddr.Compare(rs.Key) < 0 {
+			rs.Key = keyAddr
+		}
+		if endKeyAddr.Compare(rs.EndKey) > 0 {
+			rs.EndKey = endKeyAddr
+		}
+	}
+	return rs, nil
+}
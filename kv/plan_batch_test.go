@@ -0,0 +1,232 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package kv
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/keys"
+	"github.com/cockroachdb/cockroach/roachpb"
+	"github.com/cockroachdb/cockroach/testutils"
+	"github.com/cockroachdb/cockroach/util/leaktest"
+	"golang.org/x/net/context"
+)
+
+func TestPlanBatch(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	rdc := NewRangeDescriptorCache(multiRangeFixture())
+	ctx := context.Background()
+
+	ba := &roachpb.BatchRequest{}
+	ba.Add(&roachpb.GetRequest{Span: roachpb.Span{Key: roachpb.Key("a")}})
+	ba.Add(&roachpb.GetRequest{Span: roachpb.Span{Key: roachpb.Key("d")}})
+	ba.Add(&roachpb.GetRequest{Span: roachpb.Span{Key: roachpb.Key("h")}})
+	ba.Add(&roachpb.ScanRequest{Span: roachpb.Span{Key: roachpb.Key("b"), EndKey: roachpb.Key("g")}})
+
+	plans, err := PlanBatch(ctx, ba, rdc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// (c) plan count matches the number of ranges touched: [,c), [c,f), [f,i).
+	if e, a := 3, len(plans); e != a {
+		t.Fatalf("expected %d plans, got %d", e, a)
+	}
+
+	// (a) every point request is covered by exactly one plan, and the
+	// union of the scan's clipped spans across all plans reconstructs its
+	// original span.
+	for reqIdx, key := range []string{"a", "d", "h"} {
+		var covering int
+		for _, p := range plans {
+			h := p.Batch.Requests[reqIdx].GetInner().Header()
+			if len(h.Key) != 0 {
+				covering++
+				if string(h.Key) != key {
+					t.Errorf("request %d: covering plan had key %q, want %q", reqIdx, h.Key, key)
+				}
+			}
+		}
+		if covering != 1 {
+			t.Errorf("request %d (key %q): covered by %d plans, want 1", reqIdx, key, covering)
+		}
+	}
+
+	var scanStart, scanEnd roachpb.Key
+	for _, p := range plans {
+		h := p.Batch.Requests[3].GetInner().Header()
+		if len(h.Key) == 0 {
+			continue
+		}
+		if scanStart == nil || h.Key.Compare(scanStart) < 0 {
+			scanStart = h.Key
+		}
+		if scanEnd == nil || h.EndKey.Compare(scanEnd) > 0 {
+			scanEnd = h.EndKey
+		}
+	}
+	if string(scanStart) != "b" || string(scanEnd) != "g" {
+		t.Errorf("scan's clipped spans reconstructed to [%q,%q), want [\"b\",\"g\")", scanStart, scanEnd)
+	}
+
+	// The original batch must be untouched.
+	if h := ba.Requests[0].GetInner().Header(); string(h.Key) != "a" {
+		t.Errorf("PlanBatch mutated the input batch: %s", ba)
+	}
+}
+
+// TestPlanBatchNonContiguousKeys guards against a plan that silently
+// drops a request living in a range that no other request touches: ba's
+// two Gets leave the [c,f) range, which their combined span crosses,
+// with nothing of its own to plan.
+func TestPlanBatchNonContiguousKeys(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	rdc := NewRangeDescriptorCache(multiRangeFixture())
+	ctx := context.Background()
+
+	ba := &roachpb.BatchRequest{}
+	ba.Add(&roachpb.GetRequest{Span: roachpb.Span{Key: roachpb.Key("a")}})
+	ba.Add(&roachpb.GetRequest{Span: roachpb.Span{Key: roachpb.Key("h")}})
+
+	plans, err := PlanBatch(ctx, ba, rdc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only [,c) and [f,i) have anything to send; the empty [c,f) range in
+	// between must be skipped rather than ending the plan early.
+	if e, a := 2, len(plans); e != a {
+		t.Fatalf("expected %d plans, got %d", e, a)
+	}
+
+	for reqIdx, key := range []string{"a", "h"} {
+		var covering int
+		for _, p := range plans {
+			if h := p.Batch.Requests[reqIdx].GetInner().Header(); len(h.Key) != 0 {
+				covering++
+				if string(h.Key) != key {
+					t.Errorf("request %d: covering plan had key %q, want %q", reqIdx, h.Key, key)
+				}
+			}
+		}
+		if covering != 1 {
+			t.Errorf("request %d (key %q): covered by %d plans, want 1", reqIdx, key, covering)
+		}
+	}
+}
+
+// TestPlanBatchReverse verifies PlanBatch's reverse-scan branch, mirroring
+// TestRangeIteratorReverse: plans must come back in increasing key order
+// regardless of the traversal direction used to build them.
+func TestPlanBatchReverse(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	rdc := NewRangeDescriptorCache(multiRangeFixture())
+	ctx := context.Background()
+
+	ba := &roachpb.BatchRequest{}
+	ba.Add(&roachpb.ReverseScanRequest{Span: roachpb.Span{Key: roachpb.Key("a"), EndKey: roachpb.Key("h")}})
+
+	plans, err := PlanBatch(ctx, ba, rdc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var seen []string
+	for _, p := range plans {
+		seen = append(seen, string(p.Desc.StartKey)+":"+string(p.Desc.EndKey))
+	}
+	if expSeen := []string{":c", "c:f", "f:i"}; !reflect.DeepEqual(seen, expSeen) {
+		t.Errorf("plans in order %v, expected %v", seen, expSeen)
+	}
+
+	var scanStart, scanEnd roachpb.Key
+	for _, p := range plans {
+		h := p.Batch.Requests[0].GetInner().Header()
+		if len(h.Key) == 0 {
+			continue
+		}
+		if scanStart == nil || h.Key.Compare(scanStart) < 0 {
+			scanStart = h.Key
+		}
+		if scanEnd == nil || h.EndKey.Compare(scanEnd) > 0 {
+			scanEnd = h.EndKey
+		}
+	}
+	if string(scanStart) != "a" || string(scanEnd) != "h" {
+		t.Errorf("scan's clipped spans reconstructed to [%q,%q), want [\"a\",\"h\")", scanStart, scanEnd)
+	}
+}
+
+func TestPlanBatchLocalKeySpansRanges(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	rdc := NewRangeDescriptorCache(multiRangeFixture())
+	ctx := context.Background()
+
+	loc := func(s string) roachpb.Key {
+		return keys.RangeDescriptorKey(roachpb.RKey(s))
+	}
+
+	ba := &roachpb.BatchRequest{}
+	ba.Add(&roachpb.ScanRequest{
+		Span: roachpb.Span{Key: loc("b"), EndKey: loc("d")},
+	})
+
+	if _, err := PlanBatch(ctx, ba, rdc); !testutils.IsError(err, "local key range must not span ranges") {
+		t.Fatalf("got %v, expected local key range must not span ranges error", err)
+	}
+}
+
+func TestCountRanges(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	rdc := NewRangeDescriptorCache(multiRangeFixture())
+	ctx := context.Background()
+
+	ba := &roachpb.BatchRequest{}
+	ba.Add(&roachpb.ScanRequest{Span: roachpb.Span{Key: roachpb.Key("a"), EndKey: roachpb.Key("h")}})
+
+	n, err := CountRanges(ctx, ba, rdc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := 3; n != e {
+		t.Errorf("expected %d ranges, got %d", e, n)
+	}
+	if h := ba.Requests[0].GetInner().Header(); string(h.Key) != "a" || string(h.EndKey) != "h" {
+		t.Errorf("CountRanges mutated the input batch: %s", ba)
+	}
+}
+
+// TestCountRangesNonContiguousKeys verifies CountRanges doesn't undercount
+// when a gap between requests spans one or more ranges with nothing to
+// send: the empty [c,f) range must still be skipped over, not mistaken
+// for the end of ba's span.
+func TestCountRangesNonContiguousKeys(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	rdc := NewRangeDescriptorCache(multiRangeFixture())
+	ctx := context.Background()
+
+	ba := &roachpb.BatchRequest{}
+	ba.Add(&roachpb.GetRequest{Span: roachpb.Span{Key: roachpb.Key("a")}})
+	ba.Add(&roachpb.GetRequest{Span: roachpb.Span{Key: roachpb.Key("h")}})
+
+	n, err := CountRanges(ctx, ba, rdc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := 2; n != e {
+		t.Errorf("expected %d ranges, got %d", e, n)
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package kv
+
+import (
+	"github.com/cockroachdb/cockroach/roachpb"
+	"github.com/cockroachdb/cockroach/util/syncutil"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// RangeDescriptorDB is the source of truth consulted by a
+// RangeDescriptorCache on a cache miss -- normally the meta ranges,
+// reached over KV. RangeLookup returns the descriptor(s) covering key; in
+// reverse mode it returns the descriptor immediately preceding key rather
+// than the one key itself falls in, mirroring a reverse scan's own
+// resume semantics.
+type RangeDescriptorDB interface {
+	RangeLookup(ctx context.Context, key roachpb.RKey, useReverseScan bool) ([]roachpb.RangeDescriptor, error)
+}
+
+// evictionToken identifies a specific descriptor returned by
+// RangeDescriptorCache.LookupRangeDescriptor, so that a caller which
+// discovers it is stale (for instance, after a NotLeaseHolderError or a
+// RangeKeyMismatchError) can evict exactly that cache entry without
+// racing a concurrent lookup that may have already replaced it.
+type evictionToken struct {
+	rdc  *RangeDescriptorCache
+	desc roachpb.RangeDescriptor
+}
+
+// Evict removes the descriptor this token was issued for from the cache,
+// provided it hasn't already been replaced by a fresher lookup.
+func (et *evictionToken) Evict(ctx context.Context) {
+	if et == nil {
+		return
+	}
+	et.rdc.mu.Lock()
+	defer et.rdc.mu.Unlock()
+	if cur, ok := et.rdc.cache[string(et.desc.StartKey)]; ok && cur.Equal(&et.desc) {
+		delete(et.rdc.cache, string(et.desc.StartKey))
+	}
+}
+
+// RangeDescriptorCache caches range descriptors by start key, filling
+// misses from db. It is safe for concurrent use.
+type RangeDescriptorCache struct {
+	db RangeDescriptorDB
+
+	mu    syncutil.Mutex
+	cache map[string]*roachpb.RangeDescriptor
+}
+
+// NewRangeDescriptorCache creates a RangeDescriptorCache backed by db.
+func NewRangeDescriptorCache(db RangeDescriptorDB) *RangeDescriptorCache {
+	return &RangeDescriptorCache{
+		db:    db,
+		cache: map[string]*roachpb.RangeDescriptor{},
+	}
+}
+
+// LookupRangeDescriptor returns the range descriptor containing key (or,
+// if useReverseScan is true, the descriptor immediately preceding key),
+// consulting the cache first and falling back to rdc's RangeDescriptorDB
+// on a miss. If evictToken is non-nil, it is evicted before the lookup is
+// attempted, so that a caller who already knows its cached answer was
+// stale doesn't get it served right back.
+func (rdc *RangeDescriptorCache) LookupRangeDescriptor(
+	ctx context.Context, key roachpb.RKey, evictToken *evictionToken, useReverseScan bool,
+) (*roachpb.RangeDescriptor, *evictionToken, error) {
+	evictToken.Evict(ctx)
+
+	if desc := rdc.getCachedLocked(key, useReverseScan); desc != nil {
+		return desc, &evictionToken{rdc: rdc, desc: *desc}, nil
+	}
+
+	descs, err := rdc.db.RangeLookup(ctx, key, useReverseScan)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "looking up range descriptor for key %s", key)
+	}
+	if len(descs) == 0 {
+		return nil, nil, errors.Errorf("no range descriptor found for key %s", key)
+	}
+	desc := descs[0]
+
+	rdc.mu.Lock()
+	rdc.cache[string(desc.StartKey)] = &desc
+	rdc.mu.Unlock()
+
+	return &desc, &evictionToken{rdc: rdc, desc: desc}, nil
+}
+
+func (rdc *RangeDescriptorCache) getCachedLocked(
+	key roachpb.RKey, useReverseScan bool,
+) *roachpb.RangeDescriptor {
+	rdc.mu.Lock()
+	defer rdc.mu.Unlock()
+	for _, desc := range rdc.cache {
+		if useReverseScan {
+			if desc.ContainsKeyInverted(key) {
+				return desc
+			}
+			continue
+		}
+		if desc.ContainsKey(key) {
+			return desc
+		}
+	}
+	return nil
+}
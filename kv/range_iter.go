@@ -0,0 +1,206 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package kv
+
+import (
+	"github.com/cockroachdb/cockroach/roachpb"
+	"golang.org/x/net/context"
+)
+
+// RangeIterator walks the ranges covering a BatchRequest's span, either in
+// forward or reverse key order, yielding at each step the range
+// descriptor and the ba, truncated in place to that range's portion of
+// the span. It replaces the per-call loops that used to be open-coded in
+// DistSender's sendChunk and CountRanges, and gives other callers (backup,
+// bulk deletion, schema changes) a reusable way to stream a batch over
+// ranges without first materializing every range it touches.
+//
+// The zero value is not usable; create one with NewRangeIterator. Typical
+// use:
+//
+//	ri := NewRangeIterator(rdc, ba, rs, reverse)
+//	for ri.Seek(ctx, startKey); ri.Valid(); ri.Next(ctx) {
+//	    // send ri.Batch() to ri.Desc().
+//	    ri.Undo()()
+//	}
+//	if err := ri.Error(); err != nil {
+//	    return err
+//	}
+type RangeIterator struct {
+	rdc     *RangeDescriptorCache
+	ba      *roachpb.BatchRequest
+	reverse bool
+
+	// rs is the portion of the original span not yet covered.
+	rs roachpb.RSpan
+
+	desc       *roachpb.RangeDescriptor
+	evictToken *evictionToken
+	num        int
+	undo       func()
+
+	valid bool
+	err   error
+}
+
+// Evict evicts the descriptor the iterator is currently positioned at
+// from rdc, for use when the caller has independently learned (e.g. from
+// a RangeKeyMismatchError on the RPC it just sent) that the descriptor is
+// stale. It is not called automatically between steps: an ordinary
+// Seek/Next advance says nothing about whether the range just left
+// behind was stale, so it must not evict it.
+func (ri *RangeIterator) Evict(ctx context.Context) {
+	ri.evictToken.Evict(ctx)
+}
+
+// NewRangeIterator creates a RangeIterator over ba, restricted to rs. It
+// visits ranges in increasing key order if reverse is false, and in
+// decreasing key order if reverse is true. Call Seek before using it.
+func NewRangeIterator(
+	rdc *RangeDescriptorCache, ba *roachpb.BatchRequest, rs roachpb.RSpan, reverse bool,
+) *RangeIterator {
+	return &RangeIterator{rdc: rdc, ba: ba, rs: rs, reverse: reverse}
+}
+
+// Valid returns whether the iterator is positioned at a range with a
+// non-empty truncated batch to send. It must be checked after Seek and
+// after every call to Next; once it returns false, Error reports whether
+// that was because the span was exhausted (nil) or a lookup failed.
+func (ri *RangeIterator) Valid() bool {
+	return ri.valid
+}
+
+// Error returns the error, if any, that caused the iterator to stop being
+// Valid.
+func (ri *RangeIterator) Error() error {
+	return ri.err
+}
+
+// Desc returns the range descriptor at the iterator's current position.
+// It must only be called while Valid returns true.
+func (ri *RangeIterator) Desc() *roachpb.RangeDescriptor {
+	return ri.desc
+}
+
+// Batch returns ba truncated to the current range, along with the number
+// of its non-noop requests. It must only be called while Valid returns
+// true; the returned batch aliases ba and remains truncated until Undo's
+// result is invoked.
+func (ri *RangeIterator) Batch() (*roachpb.BatchRequest, int) {
+	return ri.ba, ri.num
+}
+
+// Undo returns the function that restores ba's request headers to what
+// they were before this step's truncation. The caller should invoke it
+// once it's done sending the current step's batch, before reading Desc or
+// Batch again.
+func (ri *RangeIterator) Undo() func() {
+	return ri.undo
+}
+
+// Seek positions the iterator at the range containing key (forward mode)
+// or preceding key (reverse mode), looking up the descriptor via rdc as
+// necessary, and truncates ba to the intersection of that range and the
+// iterator's remaining span. If that range holds none of ba's requests,
+// the iterator moves on to the next range in its direction that does.
+// Valid must be checked afterwards.
+func (ri *RangeIterator) Seek(ctx context.Context, key roachpb.RKey) {
+	if ri.reverse {
+		ri.rs.EndKey = key
+	} else {
+		ri.rs.Key = key
+	}
+	ri.advance(ctx, key)
+}
+
+// Next advances the iterator to the first range after desc.EndKey (forward
+// mode) or before desc.StartKey (reverse mode) that holds at least one of
+// ba's requests, undoing the previous step's truncation first. Valid must be checked afterwards. Next is a
+// no-op once Valid has returned false.
+func (ri *RangeIterator) Next(ctx context.Context) {
+	if !ri.valid {
+		return
+	}
+	ri.undo()
+
+	var key roachpb.RKey
+	if ri.reverse {
+		ri.rs.EndKey = ri.desc.StartKey
+		key = ri.rs.EndKey
+	} else {
+		ri.rs.Key = ri.desc.EndKey
+		key = ri.rs.Key
+	}
+	ri.advance(ctx, key)
+}
+
+// advance looks up the descriptor covering key, truncates ba to its
+// intersection with ri.rs, and updates ri.valid/ri.err accordingly. If a
+// range contributes no live requests -- a gap between two of ba's
+// requests that happens to span one or more ranges -- it does not stop
+// there; it uses next/prev to jump straight to the range that contains
+// the nearest request the iterator hasn't visited yet, rather than
+// looking up every intervening range one at a time. It stops
+// (Valid() == false, Error() == nil) once the remaining span is
+// exhausted.
+func (ri *RangeIterator) advance(ctx context.Context, key roachpb.RKey) {
+	ri.valid, ri.err = false, nil
+
+	for {
+		if ri.rs.Key.Compare(ri.rs.EndKey) >= 0 {
+			return
+		}
+		if ri.reverse {
+			if key.Compare(ri.rs.Key) <= 0 {
+				return
+			}
+		} else if key.Compare(ri.rs.EndKey) >= 0 {
+			return
+		}
+
+		// Always look up fresh: nothing about a routine advance to the
+		// next key indicates that the descriptor for the range just left
+		// behind was stale, so we must not feed it back in as the token
+		// to evict. A caller who independently learns a descriptor was
+		// stale can evict it itself via Evict before re-seeking.
+		desc, evictToken, err := ri.rdc.LookupRangeDescriptor(ctx, key, nil, ri.reverse)
+		if err != nil {
+			ri.err = err
+			return
+		}
+
+		undo, num, err := truncate(ri.ba, desc, ri.rs.Key, ri.rs.EndKey)
+		if err != nil {
+			ri.err = err
+			return
+		}
+
+		if num > 0 {
+			ri.desc, ri.evictToken, ri.undo, ri.num = desc, evictToken, undo, num
+			ri.valid = true
+			return
+		}
+
+		// This range has nothing to send; skip ahead to wherever the
+		// nearest request the iterator hasn't yet covered actually lies,
+		// instead of paying for a lookup on every range in between.
+		undo()
+		if ri.reverse {
+			key = prev(ri.ba, desc.StartKey)
+		} else {
+			key = next(ri.ba, desc.EndKey)
+		}
+	}
+}
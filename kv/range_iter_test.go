@@ -0,0 +1,252 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package kv
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/roachpb"
+	"github.com/cockroachdb/cockroach/util/leaktest"
+	"github.com/gogo/protobuf/proto"
+	"golang.org/x/net/context"
+)
+
+// fixtureRangeDescriptorDB serves a fixed, sorted list of range
+// descriptors, split at the given keys, without ever hitting the network.
+type fixtureRangeDescriptorDB []roachpb.RangeDescriptor
+
+func (f fixtureRangeDescriptorDB) RangeLookup(
+	_ context.Context, key roachpb.RKey, useReverseScan bool,
+) ([]roachpb.RangeDescriptor, error) {
+	for _, desc := range f {
+		if useReverseScan {
+			if desc.ContainsKeyInverted(key) {
+				return []roachpb.RangeDescriptor{desc}, nil
+			}
+			continue
+		}
+		if desc.ContainsKey(key) {
+			return []roachpb.RangeDescriptor{desc}, nil
+		}
+	}
+	return nil, nil
+}
+
+func multiRangeFixture() fixtureRangeDescriptorDB {
+	splits := []string{"", "c", "f", "i", ""}
+	descs := make(fixtureRangeDescriptorDB, len(splits)-1)
+	for i := range descs {
+		descs[i] = roachpb.RangeDescriptor{
+			StartKey: roachpb.RKey(splits[i]),
+			EndKey:   roachpb.RKey(splits[i+1]),
+		}
+	}
+	return descs
+}
+
+// countingRangeDescriptorDB wraps a fixtureRangeDescriptorDB and counts
+// how many times RangeLookup is actually invoked, so tests can assert on
+// cache hit/miss behavior rather than just the sequence of descriptors
+// visited.
+type countingRangeDescriptorDB struct {
+	fixtureRangeDescriptorDB
+	lookups int
+}
+
+func (c *countingRangeDescriptorDB) RangeLookup(
+	ctx context.Context, key roachpb.RKey, useReverseScan bool,
+) ([]roachpb.RangeDescriptor, error) {
+	c.lookups++
+	return c.fixtureRangeDescriptorDB.RangeLookup(ctx, key, useReverseScan)
+}
+
+// TestRangeIteratorDoesNotEvictOnAdvance guards against a RangeIterator
+// that feeds the previous step's (perfectly valid) evictionToken back in
+// as the token to evict for the next step's lookup: that would defeat the
+// cache for every range but the last one visited, forcing a fresh
+// RangeLookup on every subsequent traversal of the same span.
+func TestRangeIteratorDoesNotEvictOnAdvance(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	db := &countingRangeDescriptorDB{fixtureRangeDescriptorDB: multiRangeFixture()}
+	rdc := NewRangeDescriptorCache(db)
+
+	ba := &roachpb.BatchRequest{}
+	ba.Add(&roachpb.ScanRequest{Span: roachpb.Span{Key: roachpb.Key("a"), EndKey: roachpb.Key("h")}})
+	rs := roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("h")}
+
+	ctx := context.Background()
+	walk := func() {
+		ri := NewRangeIterator(rdc, ba, rs, false)
+		for ri.Seek(ctx, rs.Key); ri.Valid(); ri.Next(ctx) {
+			ri.Undo()()
+		}
+		if err := ri.Error(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	walk()
+	if e, a := 3, db.lookups; e != a {
+		t.Fatalf("first traversal: expected %d RangeLookup calls, got %d", e, a)
+	}
+
+	walk()
+	if e, a := 3, db.lookups; e != a {
+		t.Errorf("second traversal: expected no additional RangeLookup calls (still %d total), got %d",
+			e, a)
+	}
+}
+
+// TestRangeIteratorSkipsEmptyRanges guards against the iterator stopping
+// early the first time an intermediate range contributes no live
+// requests: ba's two Gets leave the [c,f) range, which their combined
+// span crosses, with nothing to send, and the iterator must skip past it
+// rather than treating it as the end of the traversal.
+func TestRangeIteratorSkipsEmptyRanges(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	rdc := NewRangeDescriptorCache(multiRangeFixture())
+
+	newBatch := func() *roachpb.BatchRequest {
+		ba := &roachpb.BatchRequest{}
+		ba.Add(&roachpb.GetRequest{Span: roachpb.Span{Key: roachpb.Key("a")}})
+		ba.Add(&roachpb.GetRequest{Span: roachpb.Span{Key: roachpb.Key("h")}})
+		return ba
+	}
+
+	t.Run("forward", func(t *testing.T) {
+		ba := newBatch()
+		original := proto.Clone(ba).(*roachpb.BatchRequest)
+		rs := roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("h").Next()}
+		ri := NewRangeIterator(rdc, ba, rs, false)
+
+		var seen []string
+		ctx := context.Background()
+		for ri.Seek(ctx, rs.Key); ri.Valid(); ri.Next(ctx) {
+			desc := ri.Desc()
+			seen = append(seen, string(desc.StartKey)+":"+string(desc.EndKey))
+			ri.Undo()()
+			if !reflect.DeepEqual(ba, original) {
+				t.Fatalf("undo after range %s failed to restore batch:\nexpected: %s\nactual: %s",
+					desc, original, ba)
+			}
+		}
+		if err := ri.Error(); err != nil {
+			t.Fatal(err)
+		}
+		if expSeen := []string{":c", "f:i"}; !reflect.DeepEqual(seen, expSeen) {
+			t.Errorf("visited ranges %v, expected %v (should skip the empty [c,f) range)", seen, expSeen)
+		}
+	})
+
+	t.Run("reverse", func(t *testing.T) {
+		ba := newBatch()
+		for i := range ba.Requests {
+			get := ba.Requests[i].GetInner().(*roachpb.GetRequest)
+			ba.Requests[i] = roachpb.RequestUnion{}
+			ba.Requests[i].MustSetInner(&roachpb.ReverseScanRequest{
+				Span: roachpb.Span{Key: get.Key, EndKey: get.Key.Next()},
+			})
+		}
+		original := proto.Clone(ba).(*roachpb.BatchRequest)
+		rs := roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("h").Next()}
+		ri := NewRangeIterator(rdc, ba, rs, true)
+
+		var seen []string
+		ctx := context.Background()
+		for ri.Seek(ctx, rs.EndKey); ri.Valid(); ri.Next(ctx) {
+			desc := ri.Desc()
+			seen = append(seen, string(desc.StartKey)+":"+string(desc.EndKey))
+			ri.Undo()()
+			if !reflect.DeepEqual(ba, original) {
+				t.Fatalf("undo after range %s failed to restore batch:\nexpected: %s\nactual: %s",
+					desc, original, ba)
+			}
+		}
+		if err := ri.Error(); err != nil {
+			t.Fatal(err)
+		}
+		if expSeen := []string{"f:i", ":c"}; !reflect.DeepEqual(seen, expSeen) {
+			t.Errorf("visited ranges %v, expected %v (should skip the empty [c,f) range)", seen, expSeen)
+		}
+	})
+}
+
+func TestRangeIteratorForward(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	rdc := NewRangeDescriptorCache(multiRangeFixture())
+
+	ba := &roachpb.BatchRequest{}
+	ba.Add(&roachpb.ScanRequest{Span: roachpb.Span{Key: roachpb.Key("a"), EndKey: roachpb.Key("h")}})
+	ba.Add(&roachpb.GetRequest{Span: roachpb.Span{Key: roachpb.Key("e")}})
+	original := proto.Clone(ba).(*roachpb.BatchRequest)
+
+	rs := roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("h")}
+	ri := NewRangeIterator(rdc, ba, rs, false)
+
+	var seen []string
+	ctx := context.Background()
+	for ri.Seek(ctx, rs.Key); ri.Valid(); ri.Next(ctx) {
+		desc := ri.Desc()
+		seen = append(seen, string(desc.StartKey)+":"+string(desc.EndKey))
+		if _, num := ri.Batch(); num == 0 {
+			t.Errorf("yielded a range with no live requests: %s", desc)
+		}
+		ri.Undo()()
+		if !reflect.DeepEqual(ba, original) {
+			t.Fatalf("undo after range %s failed to restore batch:\nexpected: %s\nactual: %s",
+				desc, original, ba)
+		}
+	}
+	if err := ri.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if expSeen := []string{":c", "c:f", "f:i"}; !reflect.DeepEqual(seen, expSeen) {
+		t.Errorf("visited ranges %v, expected %v", seen, expSeen)
+	}
+}
+
+func TestRangeIteratorReverse(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	rdc := NewRangeDescriptorCache(multiRangeFixture())
+
+	ba := &roachpb.BatchRequest{}
+	ba.Add(&roachpb.ReverseScanRequest{Span: roachpb.Span{Key: roachpb.Key("a"), EndKey: roachpb.Key("h")}})
+	original := proto.Clone(ba).(*roachpb.BatchRequest)
+
+	rs := roachpb.RSpan{Key: roachpb.RKey("a"), EndKey: roachpb.RKey("h")}
+	ri := NewRangeIterator(rdc, ba, rs, true)
+
+	var seen []string
+	ctx := context.Background()
+	for ri.Seek(ctx, rs.EndKey); ri.Valid(); ri.Next(ctx) {
+		desc := ri.Desc()
+		seen = append(seen, string(desc.StartKey)+":"+string(desc.EndKey))
+		if _, num := ri.Batch(); num == 0 {
+			t.Errorf("yielded a range with no live requests: %s", desc)
+		}
+		ri.Undo()()
+		if !reflect.DeepEqual(ba, original) {
+			t.Fatalf("undo after range %s failed to restore batch:\nexpected: %s\nactual: %s",
+				desc, original, ba)
+		}
+	}
+	if err := ri.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if expSeen := []string{"f:i", "c:f", ":c"}; !reflect.DeepEqual(seen, expSeen) {
+		t.Errorf("visited ranges %v, expected %v", seen, expSeen)
+	}
+}
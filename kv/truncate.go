@@ -0,0 +1,197 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package kv
+
+import (
+	"bytes"
+
+	"github.com/cockroachdb/cockroach/keys"
+	"github.com/cockroachdb/cockroach/roachpb"
+	"github.com/pkg/errors"
+)
+
+// next returns the smallest key, among ba's requests' own start keys, that
+// is greater than or equal to k -- the key at which the next as-yet-untouched
+// request begins. It is used by a forward traversal to jump straight to
+// the next range actually worth looking up after one contributes no live
+// requests, rather than stepping through every intervening range one at a
+// time. If every request starts before k, there is nothing left to
+// jump to and next returns roachpb.RKeyMax.
+func next(ba *roachpb.BatchRequest, k roachpb.RKey) roachpb.RKey {
+	candidate := roachpb.RKeyMax
+	for _, union := range ba.Requests {
+		h := union.GetInner().Header()
+		keyAddr, err := keys.Addr(h.Key)
+		if err != nil {
+			continue
+		}
+		if keyAddr.Compare(k) < 0 {
+			// Already passed by a previous range.
+			continue
+		}
+		if keyAddr.Compare(candidate) < 0 {
+			candidate = keyAddr
+		}
+	}
+	return candidate
+}
+
+// prev is the reverse-scan counterpart to next: it returns the largest end
+// key, among ba's requests' own end keys (a point request's end key being
+// its key's immediate successor), that is less than or equal to k. It is
+// used by a reverse traversal to jump straight down to the next range
+// actually worth looking up after one contributes no live requests. If
+// every request ends after k, there is nothing left to jump to and prev
+// returns roachpb.RKeyMin.
+func prev(ba *roachpb.BatchRequest, k roachpb.RKey) roachpb.RKey {
+	candidate := roachpb.RKeyMin
+	for _, union := range ba.Requests {
+		h := union.GetInner().Header()
+		eAddr, err := keys.Addr(h.EndKey)
+		if len(h.EndKey) == 0 {
+			var kAddr roachpb.RKey
+			kAddr, err = keys.Addr(h.Key)
+			eAddr = kAddr.Next()
+		}
+		if err != nil {
+			continue
+		}
+		if eAddr.Compare(k) > 0 {
+			// Not yet reached by a previous range.
+			continue
+		}
+		if eAddr.Compare(candidate) > 0 {
+			candidate = eAddr
+		}
+	}
+	return candidate
+}
+
+// truncate restricts all requests to the intersection of the given [from, to) key
+// range and desc's own span, rewriting any request (or portion of a
+// ranged request) which falls outside of that intersection into a
+// roachpb.NoopRequest. It returns a function which undoes the truncation,
+// restoring ba's requests exactly as they were; the number of requests
+// which remain active (non-noop) after truncation; and an error if a
+// range-local request's span cannot unambiguously be resolved to lie
+// entirely inside or entirely outside the truncated range.
+//
+// truncate applies the same clipping to forward and reverse requests
+// alike: it only rewrites the [Key, EndKey) span carried in a request's
+// header, which both roachpb.ScanRequest and roachpb.ReverseScanRequest
+// expose identically. Direction only matters to callers choosing which
+// end of the range to resume from next, such as RangeIterator.
+func truncate(
+	ba *roachpb.BatchRequest, desc *roachpb.RangeDescriptor, from, to roachpb.RKey,
+) (func(), int, error) {
+	if from.Compare(desc.StartKey) < 0 {
+		from = desc.StartKey
+	}
+	if to.Compare(desc.EndKey) > 0 {
+		to = desc.EndKey
+	}
+
+	origUnions := make([]roachpb.RequestUnion, len(ba.Requests))
+	origHeaders := make([]roachpb.Span, len(ba.Requests))
+	for i, union := range ba.Requests {
+		origUnions[i] = union
+		origHeaders[i] = union.GetInner().Header()
+	}
+	undo := func() {
+		for i := range ba.Requests {
+			ba.Requests[i] = origUnions[i]
+			ba.Requests[i].GetInner().SetHeader(origHeaders[i])
+		}
+	}
+
+	drop := func(i int) {
+		ba.Requests[i] = roachpb.RequestUnion{}
+		ba.Requests[i].MustSetInner(&roachpb.NoopRequest{})
+	}
+
+	var num int
+	for i, union := range ba.Requests {
+		req := union.GetInner()
+		if _, ok := req.(*roachpb.NoopRequest); ok {
+			continue
+		}
+		header := req.Header()
+		local := keys.IsLocal(header.Key)
+		keyAddr, err := keys.Addr(header.Key)
+		if err != nil {
+			undo()
+			return nil, 0, err
+		}
+		var endKeyAddr roachpb.RKey
+		if len(header.EndKey) == 0 {
+			endKeyAddr = keyAddr
+		} else {
+			if keys.IsLocal(header.EndKey) != local {
+				undo()
+				return nil, 0, errors.Errorf("local key mixed with global key in range")
+			}
+			if endKeyAddr, err = keys.Addr(header.EndKey); err != nil {
+				undo()
+				return nil, 0, err
+			}
+		}
+
+		if len(header.EndKey) == 0 {
+			// Point request, range-local or not.
+			if keyAddr.Compare(from) < 0 || keyAddr.Compare(to) >= 0 {
+				drop(i)
+				continue
+			}
+			num++
+			continue
+		}
+
+		if local {
+			switch {
+			case keyAddr.Compare(from) >= 0 && endKeyAddr.Compare(to) <= 0:
+				// Entirely inside: leave untouched.
+				num++
+			case endKeyAddr.Compare(from) < 0 || keyAddr.Compare(to) >= 0:
+				// Entirely outside: drop.
+				drop(i)
+			default:
+				// Neither: a local key range may not span ranges, as the
+				// range-local addressing scheme requires it to belong
+				// unambiguously to a single range.
+				undo()
+				return nil, 0, errors.Errorf("local key range must not span ranges")
+			}
+			continue
+		}
+
+		// Ranged request (Scan, ReverseScan, DeleteRange, ...): clip down
+		// to the intersection with [from, to).
+		newKey, newEndKey := header.Key, header.EndKey
+		if keyAddr.Compare(from) < 0 {
+			newKey = from.AsRawKey()
+		}
+		if endKeyAddr.Compare(to) > 0 {
+			newEndKey = to.AsRawKey()
+		}
+		if bytes.Compare(newKey, newEndKey) >= 0 {
+			drop(i)
+			continue
+		}
+		header.Key, header.EndKey = newKey, newEndKey
+		req.SetHeader(header)
+		num++
+	}
+	return undo, num, nil
+}
@@ -23,6 +23,7 @@ func TestTruncate(t *testing.T) {
 		from, to string
 		desc     [2]string // optional, defaults to {from,to}
 		err      string
+		reverse  bool // build ranged keys as ReverseScanRequest instead of ScanRequest
 	}{
 		{
 			// Keys inside of active range.
@@ -86,15 +87,51 @@ func TestTruncate(t *testing.T) {
 			from:    "d", to: "p",
 			desc: [2]string{"a", "z"},
 		},
+		{
+			// Reverse-scan analogue of the first case: keys inside the
+			// active range are left untouched.
+			keys:    [][2]string{{"a", "q"}, {"c"}, {"p", "q"}},
+			expKeys: [][2]string{{"a", "q"}, {"c"}, {"p", "q"}},
+			from:    "a", to: "q\x00",
+			reverse: true,
+		},
+		{
+			// Reverse-scan analogue of the touching/intersecting case.
+			keys:    [][2]string{{"a", "b"}, {"a", "c"}, {"p", "q"}, {"p", "r"}, {"a", "z"}},
+			expKeys: [][2]string{{}, {"b", "c"}, {"p", "q"}, {"p", "q"}, {"b", "q"}},
+			from:    "b", to: "q",
+			reverse: true,
+		},
+		{
+			// Range-local reverse-scan contained in the active range, mixed
+			// with a point reverse-scan (i.e. a Get) in the same batch.
+			keys:    [][2]string{{loc("b"), loc("e") + "\x00"}, {"c"}},
+			expKeys: [][2]string{{loc("b"), loc("e") + "\x00"}, {"c"}},
+			from:    "b", to: "e\x00",
+			reverse: true,
+		},
+		{
+			// Range-local reverse-scan not contained in the active range.
+			keys: [][2]string{{loc("a"), loc("b")}},
+			from: "b", to: "e",
+			err:     "local key range must not span ranges",
+			reverse: true,
+		},
 	}
 
 	for i, test := range testCases {
 		ba := &roachpb.BatchRequest{}
 		for _, ks := range test.keys {
 			if len(ks[1]) > 0 {
-				ba.Add(&roachpb.ScanRequest{
-					Span: roachpb.Span{Key: roachpb.Key(ks[0]), EndKey: roachpb.Key(ks[1])},
-				})
+				if test.reverse {
+					ba.Add(&roachpb.ReverseScanRequest{
+						Span: roachpb.Span{Key: roachpb.Key(ks[0]), EndKey: roachpb.Key(ks[1])},
+					})
+				} else {
+					ba.Add(&roachpb.ScanRequest{
+						Span: roachpb.Span{Key: roachpb.Key(ks[0]), EndKey: roachpb.Key(ks[1])},
+					})
+				}
 			} else {
 				ba.Add(&roachpb.GetRequest{
 					Span: roachpb.Span{Key: roachpb.Key(ks[0])},
@@ -141,3 +178,74 @@ func TestTruncate(t *testing.T) {
 		}
 	}
 }
+
+// TestNextPrev verifies the forward and reverse continuation-key helpers
+// used to jump past ranges that contribute no live requests instead of
+// looking each one up individually.
+func TestNextPrev(t *testing.T) {
+	defer leaktest.AfterTest(t)
+	batch := func(spans ...[2]string) *roachpb.BatchRequest {
+		ba := &roachpb.BatchRequest{}
+		for _, s := range spans {
+			if len(s[1]) > 0 {
+				ba.Add(&roachpb.ScanRequest{
+					Span: roachpb.Span{Key: roachpb.Key(s[0]), EndKey: roachpb.Key(s[1])},
+				})
+			} else {
+				ba.Add(&roachpb.GetRequest{
+					Span: roachpb.Span{Key: roachpb.Key(s[0])},
+				})
+			}
+		}
+		return ba
+	}
+
+	testCases := []struct {
+		ba   *roachpb.BatchRequest
+		k    string
+		next string
+		prev string
+	}{
+		{
+			// A single point request to the right of k: next jumps
+			// straight to it; prev has nothing behind k to reach yet.
+			ba:   batch([2]string{"c", ""}),
+			k:    "a",
+			next: "c",
+			prev: string(roachpb.RKeyMin),
+		},
+		{
+			// A single ranged request straddling k is already under way
+			// on both sides, so neither helper has anywhere to jump.
+			ba:   batch([2]string{"a", "e"}),
+			k:    "c",
+			next: string(roachpb.RKeyMax),
+			prev: string(roachpb.RKeyMin),
+		},
+		{
+			// Multiple requests: next/prev each pick the one nearest k on
+			// their own side.
+			ba:   batch([2]string{"a", "c"}, [2]string{"d", "f"}),
+			k:    "c",
+			next: "d",
+			prev: "c",
+		},
+		{
+			// A single point request already behind k: prev jumps back
+			// to it; next has nothing left ahead.
+			ba:   batch([2]string{"a", ""}),
+			k:    "z",
+			next: string(roachpb.RKeyMax),
+			prev: "a\x00",
+		},
+	}
+
+	for i, test := range testCases {
+		if a, e := next(test.ba, roachpb.RKey(test.k)), roachpb.RKey(test.next); !a.Equal(e) {
+			t.Errorf("%d: next: got %q, expected %q", i, a, e)
+		}
+		if a, e := prev(test.ba, roachpb.RKey(test.k)), roachpb.RKey(test.prev); !a.Equal(e) {
+			t.Errorf("%d: prev: got %q, expected %q", i, a, e)
+		}
+	}
+}